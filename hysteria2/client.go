@@ -3,6 +3,7 @@ package hysteria2
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -32,40 +33,59 @@ const (
 )
 
 type ClientOptions struct {
-	Context            context.Context
-	Dialer             N.Dialer
-	Logger             logger.Logger
-	BrutalDebug        bool
-	ServerAddress      M.Socksaddr
-	SendBPS            uint64
-	ReceiveBPS         uint64
-	SalamanderPassword string
-	Password           string
-	TLSConfig          *tls.Config
-	UDPDisabled        bool
-	CWND               int
+	Context              context.Context
+	Dialer               N.Dialer
+	Logger               logger.Logger
+	BrutalDebug          bool
+	ServerAddress        M.Socksaddr
+	SendBPS              uint64
+	ReceiveBPS           uint64
+	ObfuscationType      string
+	ObfuscationPassword  string
+	Password             string
+	TLSConfig            *tls.Config
+	UDPDisabled          bool
+	CWND                 int
+	ServerPorts          []string
+	HopInterval          time.Duration
+	CongestionControl    string
+	ZeroRTTHandshake     bool
+	HandshakeIdleTimeout time.Duration
 }
 
 type Client struct {
-	ctx                context.Context
-	dialer             N.Dialer
-	logger             logger.Logger
-	brutalDebug        bool
-	serverAddr         M.Socksaddr
-	sendBPS            uint64
-	receiveBPS         uint64
-	salamanderPassword string
-	password           string
-	tlsConfig          *tls.Config
-	quicConfig         *quic.Config
-	udpDisabled        bool
-	cwnd               int
+	ctx                 context.Context
+	dialer              N.Dialer
+	logger              logger.Logger
+	brutalDebug         bool
+	serverAddr          M.Socksaddr
+	sendBPS             uint64
+	receiveBPS          uint64
+	obfuscationType     string
+	obfuscationPassword string
+	password            string
+	tlsConfig           *tls.Config
+	quicConfig          *quic.Config
+	udpDisabled         bool
+	cwnd                int
+	hopPorts            []uint16
+	hopInterval         time.Duration
+	congestionControl   string
+	zeroRTTHandshake    bool
 
 	connAccess sync.RWMutex
 	conn       *clientQUICConnection
 }
 
 func NewClient(options ClientOptions) (*Client, error) {
+	var hopPorts []uint16
+	if len(options.ServerPorts) > 0 {
+		var err error
+		hopPorts, err = parseServerPorts(options.ServerPorts)
+		if err != nil {
+			return nil, E.Cause(err, "parse server ports")
+		}
+	}
 	quicConfig := &quic.Config{
 		DisablePathMTUDiscovery:        !(runtime.GOOS == "windows" || runtime.GOOS == "linux" || runtime.GOOS == "android" || runtime.GOOS == "darwin"),
 		EnableDatagrams:                true,
@@ -75,21 +95,30 @@ func NewClient(options ClientOptions) (*Client, error) {
 		MaxConnectionReceiveWindow:     defaultConnReceiveWindow,
 		MaxIdleTimeout:                 defaultMaxIdleTimeout,
 		KeepAlivePeriod:                defaultKeepAlivePeriod,
+		HandshakeIdleTimeout:           options.HandshakeIdleTimeout,
+	}
+	if options.ZeroRTTHandshake && options.TLSConfig.ClientSessionCache == nil {
+		options.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
 	}
 	return &Client{
-		ctx:                options.Context,
-		dialer:             options.Dialer,
-		logger:             options.Logger,
-		brutalDebug:        options.BrutalDebug,
-		serverAddr:         options.ServerAddress,
-		sendBPS:            options.SendBPS,
-		receiveBPS:         options.ReceiveBPS,
-		salamanderPassword: options.SalamanderPassword,
-		password:           options.Password,
-		tlsConfig:          options.TLSConfig,
-		quicConfig:         quicConfig,
-		udpDisabled:        options.UDPDisabled,
-		cwnd:               options.CWND,
+		ctx:                 options.Context,
+		dialer:              options.Dialer,
+		logger:              options.Logger,
+		brutalDebug:         options.BrutalDebug,
+		serverAddr:          options.ServerAddress,
+		sendBPS:             options.SendBPS,
+		receiveBPS:          options.ReceiveBPS,
+		obfuscationType:     options.ObfuscationType,
+		obfuscationPassword: options.ObfuscationPassword,
+		password:            options.Password,
+		tlsConfig:           options.TLSConfig,
+		quicConfig:          quicConfig,
+		udpDisabled:         options.UDPDisabled,
+		cwnd:                options.CWND,
+		hopPorts:            hopPorts,
+		hopInterval:         options.HopInterval,
+		congestionControl:   options.CongestionControl,
+		zeroRTTHandshake:    options.ZeroRTTHandshake,
 	}, nil
 }
 
@@ -112,19 +141,60 @@ func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
 }
 
 func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
-	udpConn, err := c.dialer.DialContext(c.ctx, "udp", c.serverAddr)
-	if err != nil {
-		return nil, err
+	conn, err := c.offerNewOnce(ctx)
+	if err != nil && c.zeroRTTHandshake && is0RTTRejected(err) {
+		// The server rejected our early data (e.g. it restarted and lost the
+		// session ticket's state); clear the cached ticket and retry once as
+		// a regular 1-RTT handshake instead of failing the dial outright.
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+		conn, err = c.offerNewOnce(ctx)
+	}
+	return conn, err
+}
+
+func is0RTTRejected(err error) bool {
+	return errors.Is(err, quic.Err0RTTRejected)
+}
+
+func (c *Client) offerNewOnce(ctx context.Context) (*clientQUICConnection, error) {
+	var (
+		rawConn    io.Closer
+		packetConn net.PacketConn
+	)
+	if len(c.hopPorts) > 0 {
+		// Hopping rewrites the destination port per packet and must accept
+		// replies from whichever port we last wrote to, which a connected
+		// UDP socket's kernel-level connect() filter would silently drop.
+		// Use an unconnected socket so WriteTo/ReadFrom see every port.
+		hopConn, err := c.dialer.ListenPacket(c.ctx, c.serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		rawConn = hopConn
+		packetConn = hopConn
+	} else {
+		udpConn, err := c.dialer.DialContext(c.ctx, "udp", c.serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		rawConn = udpConn
+		packetConn = bufio.NewUnbindPacketConn(udpConn)
+	}
+	if c.obfuscationPassword != "" {
+		obfuscator, err := newObfuscator(c.obfuscationType, []byte(c.obfuscationPassword))
+		if err != nil {
+			rawConn.Close()
+			return nil, E.Cause(err, "configure obfuscation")
+		}
+		packetConn = newObfsPacketConn(packetConn, obfuscator)
 	}
-	var packetConn net.PacketConn
-	packetConn = bufio.NewUnbindPacketConn(udpConn)
-	if c.salamanderPassword != "" {
-		packetConn = NewSalamanderConn(packetConn, []byte(c.salamanderPassword))
+	if len(c.hopPorts) > 0 {
+		packetConn = newObfsUDPHopConn(packetConn, c.serverAddr.UDPAddr(), c.hopPorts, c.hopInterval)
 	}
 	var quicConn quic.EarlyConnection
 	http3Transport, err := qtls.CreateTransport(packetConn, &quicConn, c.serverAddr, c.tlsConfig, c.quicConfig, true)
 	if err != nil {
-		udpConn.Close()
+		rawConn.Close()
 		return nil, err
 	}
 	request := &http.Request{
@@ -142,14 +212,14 @@ func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
 		if quicConn != nil {
 			quicConn.CloseWithError(0, "")
 		}
-		udpConn.Close()
+		rawConn.Close()
 		return nil, err
 	}
 	if response.StatusCode != protocol.StatusAuthOK {
 		if quicConn != nil {
 			quicConn.CloseWithError(0, "")
 		}
-		udpConn.Close()
+		rawConn.Close()
 		return nil, E.New("authentication failed, status code: ", response.StatusCode)
 	}
 	response.Body.Close()
@@ -161,11 +231,11 @@ func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
 	if !authResponse.RxAuto && actualTx > 0 {
 		quicConn.SetCongestionControl(hyCC.NewBrutalSender(actualTx, c.brutalDebug, c.logger))
 	} else {
-		SetCongestionController(quicConn, "bbr", c.cwnd)
+		SetCongestionController(quicConn, c.congestionControl, c.sendBPS, c.cwnd, c.logger)
 	}
 	conn := &clientQUICConnection{
 		quicConn:    quicConn,
-		rawConn:     udpConn,
+		rawConn:     rawConn,
 		connDone:    make(chan struct{}),
 		udpDisabled: c.udpDisabled || !authResponse.UDPEnabled,
 		udpConnMap:  make(map[uint32]*udpPacketConn),
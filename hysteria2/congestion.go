@@ -0,0 +1,62 @@
+package hysteria2
+
+import (
+	"sync"
+
+	"github.com/MerlinKodo/quic-go"
+	hyCC "github.com/MerlinKodo/sing-quic/hysteria2/congestion"
+	"github.com/sagernet/sing/common/logger"
+)
+
+// CongestionControlFactory builds a quic.CongestionControl for a session.
+// refBPS is the negotiated bandwidth in bytes per second, if any (0 when the
+// selected algorithm does not need one); cwnd is the configured minimum
+// congestion window, if any.
+type CongestionControlFactory func(refBPS uint64, cwnd int, logger logger.Logger) quic.CongestionControl
+
+var (
+	congestionControlAccess  sync.RWMutex
+	congestionControlFactory = make(map[string]CongestionControlFactory)
+)
+
+// RegisterCongestionControl makes a named congestion controller available to
+// ClientOptions.CongestionControl and ServiceOptions.CongestionControl,
+// allowing embedders to plug in controllers (e.g. Copa) without patching
+// this module.
+func RegisterCongestionControl(name string, factory CongestionControlFactory) {
+	congestionControlAccess.Lock()
+	defer congestionControlAccess.Unlock()
+	congestionControlFactory[name] = factory
+}
+
+func init() {
+	RegisterCongestionControl("bbr", func(refBPS uint64, cwnd int, logger logger.Logger) quic.CongestionControl {
+		return hyCC.NewBBRSender(hyCC.DefaultBBRMaxDatagramSize, cwnd)
+	})
+	RegisterCongestionControl("brutal", func(refBPS uint64, cwnd int, logger logger.Logger) quic.CongestionControl {
+		return hyCC.NewBrutalSender(refBPS, false, logger)
+	})
+	RegisterCongestionControl("cubic", func(refBPS uint64, cwnd int, logger logger.Logger) quic.CongestionControl {
+		return hyCC.NewCubicSender(cwnd)
+	})
+	RegisterCongestionControl("new_reno", func(refBPS uint64, cwnd int, logger logger.Logger) quic.CongestionControl {
+		return hyCC.NewRenoSender(cwnd)
+	})
+}
+
+// SetCongestionController installs the controller registered under name on
+// conn, falling back to BBR when name is empty or unregistered. refBPS is
+// forwarded to the factory as-is, so callers selecting "brutal" through this
+// named-registry path must pass the configured bandwidth themselves; passing
+// 0 leaves Brutal pinned to zero target bandwidth and effectively disabled.
+func SetCongestionController(conn quic.Connection, name string, refBPS uint64, cwnd int, logger logger.Logger) {
+	congestionControlAccess.RLock()
+	factory, loaded := congestionControlFactory[name]
+	congestionControlAccess.RUnlock()
+	if !loaded {
+		congestionControlAccess.RLock()
+		factory = congestionControlFactory["bbr"]
+		congestionControlAccess.RUnlock()
+	}
+	conn.SetCongestionControl(factory(refBPS, cwnd, logger))
+}
@@ -0,0 +1,112 @@
+package hysteria2
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const minHopInterval = 5 * time.Second
+
+func parseServerPorts(portList []string) ([]uint16, error) {
+	var ports []uint16
+	for _, portItem := range portList {
+		if !strings.Contains(portItem, "-") {
+			port, err := strconv.ParseUint(portItem, 10, 16)
+			if err != nil {
+				return nil, E.Cause(err, "parse port ", portItem)
+			}
+			ports = append(ports, uint16(port))
+			continue
+		}
+		rangeParts := strings.SplitN(portItem, "-", 2)
+		startPort, err := strconv.ParseUint(rangeParts[0], 10, 16)
+		if err != nil {
+			return nil, E.Cause(err, "parse start port ", rangeParts[0])
+		}
+		endPort, err := strconv.ParseUint(rangeParts[1], 10, 16)
+		if err != nil {
+			return nil, E.Cause(err, "parse end port ", rangeParts[1])
+		}
+		if endPort < startPort {
+			return nil, E.New("invalid port range ", portItem)
+		}
+		for port := startPort; port <= endPort; port++ {
+			ports = append(ports, uint16(port))
+		}
+	}
+	if len(ports) == 0 {
+		return nil, E.New("no server ports configured")
+	}
+	return ports, nil
+}
+
+// obfsUDPHopConn wraps a net.PacketConn to a fixed remote address and
+// periodically rewrites the destination port from a pool of server ports,
+// so that on-the-wire traffic hops across ports while the QUIC layer above
+// keeps observing a single, stable Socksaddr.
+type obfsUDPHopConn struct {
+	net.PacketConn
+	ports       []uint16
+	hopInterval time.Duration
+
+	access  sync.RWMutex
+	addr    *net.UDPAddr
+	done    chan struct{}
+	closeIt sync.Once
+}
+
+func newObfsUDPHopConn(conn net.PacketConn, addr *net.UDPAddr, ports []uint16, hopInterval time.Duration) *obfsUDPHopConn {
+	if hopInterval < minHopInterval {
+		hopInterval = minHopInterval
+	}
+	hopAddr := &net.UDPAddr{IP: addr.IP, Port: int(ports[rand.Intn(len(ports))]), Zone: addr.Zone}
+	hopConn := &obfsUDPHopConn{
+		PacketConn:  conn,
+		ports:       ports,
+		hopInterval: hopInterval,
+		addr:        hopAddr,
+		done:        make(chan struct{}),
+	}
+	go hopConn.loopHop()
+	return hopConn
+}
+
+func (c *obfsUDPHopConn) loopHop() {
+	ticker := time.NewTicker(c.hopInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.access.Lock()
+			newAddr := *c.addr
+			newAddr.Port = int(c.ports[rand.Intn(len(c.ports))])
+			c.addr = &newAddr
+			c.access.Unlock()
+		}
+	}
+}
+
+func (c *obfsUDPHopConn) currentAddr() *net.UDPAddr {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return c.addr
+}
+
+func (c *obfsUDPHopConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.PacketConn.WriteTo(p, c.currentAddr())
+}
+
+func (c *obfsUDPHopConn) Close() error {
+	c.closeIt.Do(func() {
+		close(c.done)
+	})
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,280 @@
+package hysteria2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// Obfuscator scrambles outgoing UDP datagrams and reverses that scrambling
+// on read, so that passive observers cannot fingerprint the QUIC long
+// header. Implementations are stateless and safe for concurrent use.
+type Obfuscator interface {
+	// Obfuscate writes the obfuscated form of src to dst and returns the
+	// number of bytes written. dst must be at least len(src)+Overhead().
+	Obfuscate(dst, src []byte) int
+	// Deobfuscate writes the deobfuscated form of src to dst and returns
+	// the number of bytes written, or -1 if src is malformed.
+	Deobfuscate(dst, src []byte) int
+	// Overhead is the number of bytes Obfuscate adds on top of the
+	// original payload.
+	Overhead() int
+}
+
+// newObfuscator resolves a configured obfuscation type to an Obfuscator,
+// defaulting to salamander so that existing deployments that only set a
+// password (and predate the ObfuscationType option) keep working unchanged.
+func newObfuscator(obfuscationType string, password []byte) (Obfuscator, error) {
+	switch obfuscationType {
+	case "", "salamander":
+		return NewSalamanderObfuscator(password), nil
+	case "xplus":
+		return NewXPlusObfuscator(password), nil
+	default:
+		return nil, E.New("unknown obfuscation type: ", obfuscationType)
+	}
+}
+
+// salamanderObfuscator XORs the whole packet against a keystream derived
+// from the shared password. It has no per-packet overhead, which also
+// means it cannot detect a corrupted or foreign packet: Deobfuscate always
+// succeeds.
+type salamanderObfuscator struct {
+	keystream [sha256.Size]byte
+}
+
+// NewSalamanderObfuscator returns the original sing-quic stream obfuscator,
+// which XORs datagrams against SHA256(password) repeated to cover the
+// packet length.
+func NewSalamanderObfuscator(password []byte) Obfuscator {
+	return &salamanderObfuscator{keystream: sha256.Sum256(password)}
+}
+
+func (o *salamanderObfuscator) Obfuscate(dst, src []byte) int {
+	if len(dst) < len(src) {
+		return -1
+	}
+	for i, b := range src {
+		dst[i] = b ^ o.keystream[i%len(o.keystream)]
+	}
+	return len(src)
+}
+
+func (o *salamanderObfuscator) Deobfuscate(dst, src []byte) int {
+	return o.Obfuscate(dst, src)
+}
+
+func (o *salamanderObfuscator) Overhead() int {
+	return 0
+}
+
+const xplusSaltLen = 8
+
+// xplusObfuscator is the Hysteria v1 XPlus obfuscator: each packet carries
+// a random 8-byte salt, and the payload is XORed against
+// SHA256(password || salt). Unlike salamander, a fresh salt per packet
+// means a known-plaintext attack on one packet does not recover a
+// keystream reusable against the rest of the session.
+type xplusObfuscator struct {
+	password []byte
+}
+
+// NewXPlusObfuscator returns the salted XPlus obfuscator.
+func NewXPlusObfuscator(password []byte) Obfuscator {
+	return &xplusObfuscator{password: password}
+}
+
+func (o *xplusObfuscator) Obfuscate(dst, src []byte) int {
+	if len(dst) < xplusSaltLen+len(src) {
+		return -1
+	}
+	salt := dst[:xplusSaltLen]
+	_, _ = rand.Read(salt)
+	keystream := sha256.Sum256(append(append(make([]byte, 0, len(o.password)+xplusSaltLen), o.password...), salt...))
+	for i, b := range src {
+		dst[xplusSaltLen+i] = b ^ keystream[i%len(keystream)]
+	}
+	return xplusSaltLen + len(src)
+}
+
+func (o *xplusObfuscator) Deobfuscate(dst, src []byte) int {
+	if len(src) < xplusSaltLen {
+		return -1
+	}
+	payload := src[xplusSaltLen:]
+	if len(dst) < len(payload) {
+		return -1
+	}
+	salt := src[:xplusSaltLen]
+	keystream := sha256.Sum256(append(append(make([]byte, 0, len(o.password)+xplusSaltLen), o.password...), salt...))
+	for i, b := range payload {
+		dst[i] = b ^ keystream[i%len(keystream)]
+	}
+	return len(payload)
+}
+
+func (o *xplusObfuscator) Overhead() int {
+	return xplusSaltLen
+}
+
+const maxObfsPacketSize = 65535
+
+// obfsPacketConn wraps a net.PacketConn, applying an Obfuscator to every
+// datagram on the way out and reversing it on the way in. It replaces the
+// old Salamander-only SalamanderConn so that either obfuscator (or any
+// future one registered through newObfuscator) can sit in the same place
+// in the dial/listen path.
+type obfsPacketConn struct {
+	net.PacketConn
+	obfuscator Obfuscator
+	readBuf    []byte
+}
+
+func newObfsPacketConn(conn net.PacketConn, obfuscator Obfuscator) *obfsPacketConn {
+	return &obfsPacketConn{
+		PacketConn: conn,
+		obfuscator: obfuscator,
+		readBuf:    make([]byte, maxObfsPacketSize),
+	}
+}
+
+func (c *obfsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		pLen := c.obfuscator.Deobfuscate(p, c.readBuf[:n])
+		if pLen < 0 {
+			// Not a packet this obfuscator produced (e.g. stray traffic on
+			// the port); drop it and keep waiting rather than surfacing
+			// garbage to the QUIC layer above.
+			continue
+		}
+		return pLen, addr, nil
+	}
+}
+
+func (c *obfsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buffer := make([]byte, len(p)+c.obfuscator.Overhead())
+	wLen := c.obfuscator.Obfuscate(buffer, p)
+	if wLen < 0 {
+		return 0, E.New("obfuscate: buffer too small")
+	}
+	_, err = c.PacketConn.WriteTo(buffer[:wLen], addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// legacyObfuscators returns, in trial order, the additional Obfuscators a
+// server listening with obfuscationType should also accept so that rolling
+// ObfuscationType forward doesn't instantly break clients still running the
+// previous setting. salamander has zero Overhead() and can't be the legacy
+// fallback for anything (there's nothing to fall back to further), so it's
+// only ever the thing other types fall back to.
+func legacyObfuscators(obfuscationType string, password []byte) []Obfuscator {
+	switch obfuscationType {
+	case "xplus":
+		return []Obfuscator{NewSalamanderObfuscator(password)}
+	default:
+		return nil
+	}
+}
+
+// looksLikeQUICPacket reports whether b could plausibly be a QUIC packet,
+// using the fixed bit (RFC 9000 section 17.2/17.3: the second-highest bit of
+// the first byte is always 1 on both long and short headers). It's a
+// heuristic, not a guarantee, but it's the only signal a deobfuscated
+// datagram carries before the QUIC stack itself would get to parse it.
+func looksLikeQUICPacket(b []byte) bool {
+	return len(b) >= 1 && b[0]&0x40 != 0
+}
+
+// serverObfsPacketConn is obfsPacketConn's server-side counterpart: it tries
+// a list of Obfuscators, in order, against each inbound datagram rather than
+// assuming a single fixed one, so a server can keep accepting clients that
+// still use the obfuscator configured before the most recent ObfuscationType
+// change. Once a remote address is seen producing a valid packet under one
+// obfuscator, that choice is cached so steady-state traffic only pays for one
+// Deobfuscate call.
+type serverObfsPacketConn struct {
+	net.PacketConn
+	obfuscators []Obfuscator
+	readBuf     []byte
+
+	cacheAccess sync.RWMutex
+	cache       map[string]Obfuscator
+}
+
+func newServerObfsPacketConn(conn net.PacketConn, obfuscators []Obfuscator) *serverObfsPacketConn {
+	return &serverObfsPacketConn{
+		PacketConn:  conn,
+		obfuscators: obfuscators,
+		readBuf:     make([]byte, maxObfsPacketSize),
+		cache:       make(map[string]Obfuscator),
+	}
+}
+
+func (c *serverObfsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		key := addr.String()
+		c.cacheAccess.RLock()
+		cached := c.cache[key]
+		c.cacheAccess.RUnlock()
+		if cached != nil {
+			if pLen := cached.Deobfuscate(p, c.readBuf[:n]); pLen >= 0 && looksLikeQUICPacket(p[:pLen]) {
+				return pLen, addr, nil
+			}
+		}
+		matched := false
+		for _, obfuscator := range c.obfuscators {
+			if cached == obfuscator {
+				continue
+			}
+			pLen := obfuscator.Deobfuscate(p, c.readBuf[:n])
+			if pLen < 0 || !looksLikeQUICPacket(p[:pLen]) {
+				continue
+			}
+			c.cacheAccess.Lock()
+			c.cache[key] = obfuscator
+			c.cacheAccess.Unlock()
+			n, matched = pLen, true
+			break
+		}
+		if !matched {
+			// None of the configured obfuscators produced a plausible QUIC
+			// packet; drop it and keep waiting rather than surfacing garbage
+			// to the QUIC layer above.
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *serverObfsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	obfuscator := c.obfuscators[0]
+	c.cacheAccess.RLock()
+	if cached, ok := c.cache[addr.String()]; ok {
+		obfuscator = cached
+	}
+	c.cacheAccess.RUnlock()
+	buffer := make([]byte, len(p)+obfuscator.Overhead())
+	wLen := obfuscator.Obfuscate(buffer, p)
+	if wLen < 0 {
+		return 0, E.New("obfuscate: buffer too small")
+	}
+	_, err = c.PacketConn.WriteTo(buffer[:wLen], addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -25,19 +25,22 @@ import (
 	N "github.com/sagernet/sing/common/network"
 )
 
-type ServiceOptions struct {
+type ServiceOptions[U comparable] struct {
 	Context               context.Context
 	Logger                logger.Logger
 	BrutalDebug           bool
 	SendBPS               uint64
 	ReceiveBPS            uint64
 	IgnoreClientBandwidth bool
-	SalamanderPassword    string
+	ObfuscationType       string
+	ObfuscationPassword   string
 	TLSConfig             *tls.Config
 	UDPDisabled           bool
 	Handler               ServerHandler
 	MasqueradeHandler     http.Handler
 	CWND                  int
+	TrafficTracker        TrafficTracker[U]
+	CongestionControl     string
 }
 
 type ServerHandler interface {
@@ -45,6 +48,32 @@ type ServerHandler interface {
 	N.UDPConnectionHandler
 }
 
+// UserOptions carries per-user overrides applied on top of the service's
+// default bandwidth when that user authenticates.
+type UserOptions[U comparable] struct {
+	User           U
+	Password       string
+	SendBPS        uint64
+	ReceiveBPS     uint64
+	MaxConnections int
+}
+
+// TrafficTracker receives accounting events for a multi-user Service. Push
+// is called each time a session moves data, with the number of bytes
+// transferred/received by that single read or write (not a running total);
+// AuthFailure is called when an unrecognized password is presented.
+type TrafficTracker[U comparable] interface {
+	Push(user U, tx uint64, rx uint64)
+	AuthFailure(source M.Socksaddr, auth string)
+}
+
+type userState[U comparable] struct {
+	user           U
+	sendBPS        uint64
+	receiveBPS     uint64
+	maxConnections int
+}
+
 type Service[U comparable] struct {
 	ctx                   context.Context
 	logger                logger.Logger
@@ -52,18 +81,26 @@ type Service[U comparable] struct {
 	sendBPS               uint64
 	receiveBPS            uint64
 	ignoreClientBandwidth bool
-	salamanderPassword    string
+	obfuscationType       string
+	obfuscationPassword   string
 	tlsConfig             *tls.Config
 	quicConfig            *quic.Config
-	userMap               map[string]U
 	udpDisabled           bool
 	handler               ServerHandler
 	masqueradeHandler     http.Handler
 	quicListener          io.Closer
 	cwnd                  int
+	trafficTracker        TrafficTracker[U]
+	congestionControl     string
+
+	userAccess sync.RWMutex
+	userMap    map[string]*userState[U]
+
+	sessionAccess  sync.Mutex
+	sessionsByUser map[U]map[*serverSession[U]]struct{}
 }
 
-func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
+func NewService[U comparable](options ServiceOptions[U]) (*Service[U], error) {
 	quicConfig := &quic.Config{
 		DisablePathMTUDiscovery:        !(runtime.GOOS == "windows" || runtime.GOOS == "linux" || runtime.GOOS == "android" || runtime.GOOS == "darwin"),
 		EnableDatagrams:                !options.UDPDisabled,
@@ -85,27 +122,100 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 		sendBPS:               options.SendBPS,
 		receiveBPS:            options.ReceiveBPS,
 		ignoreClientBandwidth: options.IgnoreClientBandwidth,
-		salamanderPassword:    options.SalamanderPassword,
+		obfuscationType:       options.ObfuscationType,
+		obfuscationPassword:   options.ObfuscationPassword,
 		tlsConfig:             options.TLSConfig,
 		quicConfig:            quicConfig,
-		userMap:               make(map[string]U),
+		userMap:               make(map[string]*userState[U]),
 		udpDisabled:           options.UDPDisabled,
 		handler:               options.Handler,
 		masqueradeHandler:     options.MasqueradeHandler,
+		cwnd:                  options.CWND,
+		trafficTracker:        options.TrafficTracker,
+		congestionControl:     options.CongestionControl,
+		sessionsByUser:        make(map[U]map[*serverSession[U]]struct{}),
 	}, nil
 }
 
-func (s *Service[U]) UpdateUsers(userList []U, passwordList []string) {
-	userMap := make(map[string]U)
-	for i, user := range userList {
-		userMap[passwordList[i]] = user
+func (s *Service[U]) UpdateUsers(users []UserOptions[U]) {
+	userMap := make(map[string]*userState[U])
+	for _, user := range users {
+		sendBPS := user.SendBPS
+		if sendBPS == 0 {
+			sendBPS = s.sendBPS
+		}
+		receiveBPS := user.ReceiveBPS
+		if receiveBPS == 0 {
+			receiveBPS = s.receiveBPS
+		}
+		userMap[user.Password] = &userState[U]{
+			user:           user.User,
+			sendBPS:        sendBPS,
+			receiveBPS:     receiveBPS,
+			maxConnections: user.MaxConnections,
+		}
 	}
+	s.userAccess.Lock()
 	s.userMap = userMap
+	s.userAccess.Unlock()
+}
+
+// Kick closes every live session currently authenticated as user, e.g.
+// after UpdateUsers has removed that user's password.
+func (s *Service[U]) Kick(user U) {
+	s.sessionAccess.Lock()
+	sessions := s.sessionsByUser[user]
+	delete(s.sessionsByUser, user)
+	s.sessionAccess.Unlock()
+	for session := range sessions {
+		session.closeWithError(E.New("kicked by server"))
+	}
+}
+
+// trackSession registers session as belonging to user, enforcing
+// maxConnections (if positive) atomically with that registration so that
+// two concurrent authentications for the same user near the limit cannot
+// both observe room to spare. It returns false, without registering the
+// session, if the limit has already been reached.
+func (s *Service[U]) trackSession(user U, session *serverSession[U], maxConnections int) bool {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	sessions, loaded := s.sessionsByUser[user]
+	if maxConnections > 0 && len(sessions) >= maxConnections {
+		return false
+	}
+	if !loaded {
+		sessions = make(map[*serverSession[U]]struct{})
+		s.sessionsByUser[user] = sessions
+	}
+	sessions[session] = struct{}{}
+	return true
+}
+
+func (s *Service[U]) untrackSession(user U, session *serverSession[U]) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	sessions, loaded := s.sessionsByUser[user]
+	if !loaded {
+		return
+	}
+	delete(sessions, session)
+	if len(sessions) == 0 {
+		delete(s.sessionsByUser, user)
+	}
 }
 
 func (s *Service[U]) Start(conn net.PacketConn) error {
-	if s.salamanderPassword != "" {
-		conn = NewSalamanderConn(conn, []byte(s.salamanderPassword))
+	if s.obfuscationPassword != "" {
+		obfuscator, err := newObfuscator(s.obfuscationType, []byte(s.obfuscationPassword))
+		if err != nil {
+			return E.Cause(err, "configure obfuscation")
+		}
+		// Also accept whatever obfuscator ObfuscationType used to be before
+		// the most recent config change, so switching it doesn't instantly
+		// break clients that haven't been rolled forward yet.
+		obfuscators := append([]Obfuscator{obfuscator}, legacyObfuscators(s.obfuscationType, []byte(s.obfuscationPassword))...)
+		conn = newServerObfsPacketConn(conn, obfuscators)
 	}
 	err := qtls.ConfigureHTTP3(s.tlsConfig)
 	if err != nil {
@@ -168,6 +278,7 @@ type serverSession[U comparable] struct {
 	connErr       error
 	authenticated bool
 	authUser      U
+	authState     *userState[U]
 	udpAccess     sync.RWMutex
 	udpConnMap    map[uint32]*udpPacketConn
 }
@@ -177,34 +288,44 @@ func (s *serverSession[U]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if s.authenticated {
 			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{
 				UDPEnabled: !s.udpDisabled,
-				Rx:         s.receiveBPS,
+				Rx:         s.authState.receiveBPS,
 				RxAuto:     s.ignoreClientBandwidth,
 			})
 			w.WriteHeader(protocol.StatusAuthOK)
 			return
 		}
 		request := protocol.AuthRequestFromHeader(r.Header)
-		user, loaded := s.userMap[request.Auth]
+		s.userAccess.RLock()
+		state, loaded := s.userMap[request.Auth]
+		s.userAccess.RUnlock()
 		if !loaded {
+			if s.trafficTracker != nil {
+				s.trafficTracker.AuthFailure(s.source, request.Auth)
+			}
 			s.masqueradeHandler.ServeHTTP(w, r)
 			return
 		}
-		s.authUser = user
+		if !s.trackSession(state.user, s, state.maxConnections) {
+			s.masqueradeHandler.ServeHTTP(w, r)
+			return
+		}
+		s.authUser = state.user
+		s.authState = state
 		s.authenticated = true
 		if !s.ignoreClientBandwidth && request.Rx > 0 {
 			var sendBps uint64
-			if s.sendBPS > 0 && s.sendBPS < request.Rx {
-				sendBps = s.sendBPS
+			if state.sendBPS > 0 && state.sendBPS < request.Rx {
+				sendBps = state.sendBPS
 			} else {
 				sendBps = request.Rx
 			}
 			s.quicConn.SetCongestionControl(hyCC.NewBrutalSender(sendBps, s.brutalDebug, s.logger))
 		} else {
-			SetCongestionController(s.quicConn, "bbr", s.cwnd)
+			SetCongestionController(s.quicConn, s.congestionControl, state.sendBPS, s.cwnd, s.logger)
 		}
 		protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{
 			UDPEnabled: !s.udpDisabled,
-			Rx:         s.receiveBPS,
+			Rx:         state.receiveBPS,
 			RxAuto:     s.ignoreClientBandwidth,
 		})
 		w.WriteHeader(protocol.StatusAuthOK)
@@ -251,7 +372,14 @@ func (s *serverSession[U]) handleStream(stream quic.Stream) error {
 		return E.New("read TCP request")
 	}
 	ctx := auth.ContextWithUser(s.ctx, s.authUser)
-	_ = s.handler.NewConnection(ctx, &serverConn{Stream: stream}, M.Metadata{
+	conn := &serverConn{Stream: stream}
+	if s.trafficTracker != nil {
+		user := s.authUser
+		tracker := s.trafficTracker
+		conn.onRx = func(n uint64) { tracker.Push(user, 0, n) }
+		conn.onTx = func(n uint64) { tracker.Push(user, n, 0) }
+	}
+	_ = s.handler.NewConnection(ctx, conn, M.Metadata{
 		Source:      s.source,
 		Destination: M.ParseSocksaddr(destinationString),
 	})
@@ -268,6 +396,9 @@ func (s *serverSession[U]) closeWithError(err error) {
 		s.connErr = err
 		close(s.connDone)
 	}
+	if s.authenticated {
+		s.untrackSession(s.authUser, s)
+	}
 	if E.IsClosedOrCanceled(err) {
 		s.logger.Debug(E.Cause(err, "connection failed"))
 	} else {
@@ -279,6 +410,8 @@ func (s *serverSession[U]) closeWithError(err error) {
 type serverConn struct {
 	quic.Stream
 	responseWritten bool
+	onRx            func(n uint64)
+	onTx            func(n uint64)
 }
 
 func (c *serverConn) HandshakeFailure(err error) error {
@@ -303,6 +436,9 @@ func (c *serverConn) HandshakeSuccess() error {
 
 func (c *serverConn) Read(p []byte) (n int, err error) {
 	n, err = c.Stream.Read(p)
+	if n > 0 && c.onRx != nil {
+		c.onRx(uint64(n))
+	}
 	return n, baderror.WrapQUIC(err)
 }
 
@@ -315,9 +451,15 @@ func (c *serverConn) Write(p []byte) (n int, err error) {
 		if err != nil {
 			return 0, baderror.WrapQUIC(err)
 		}
+		if c.onTx != nil {
+			c.onTx(uint64(len(p)))
+		}
 		return len(p), nil
 	}
 	n, err = c.Stream.Write(p)
+	if n > 0 && c.onTx != nil {
+		c.onTx(uint64(n))
+	}
 	return n, baderror.WrapQUIC(err)
 }
 
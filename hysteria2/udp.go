@@ -0,0 +1,288 @@
+package hysteria2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MerlinKodo/quic-go"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/baderror"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// maxUDPMessageSize is the largest payload carried in a single QUIC
+// datagram before a message has to be fragmented across several frames.
+const maxUDPMessageSize = 1400
+
+// udpMessage is the wire representation of a UDP relay datagram. sessionID
+// identifies the virtual UDP socket it belongs to on both ends; packetID,
+// fragID and fragCount allow reassembly when data had to be split across
+// several QUIC datagrams.
+type udpMessage struct {
+	sessionID   uint32
+	packetID    uint16
+	fragID      uint8
+	fragCount   uint8
+	destination M.Socksaddr
+	data        []byte
+}
+
+func writeUDPMessage(m udpMessage) *buf.Buffer {
+	destString := m.destination.String()
+	buffer := buf.NewSize(4 + 2 + 1 + 1 + 1 + len(destString) + len(m.data))
+	common.Must(binary.Write(buffer, binary.BigEndian, m.sessionID))
+	common.Must(binary.Write(buffer, binary.BigEndian, m.packetID))
+	buffer.WriteByte(m.fragID)
+	buffer.WriteByte(m.fragCount)
+	buffer.WriteByte(byte(len(destString)))
+	buffer.Write([]byte(destString))
+	buffer.Write(m.data)
+	return buffer
+}
+
+func readUDPMessage(data []byte) (*udpMessage, error) {
+	if len(data) < 9 {
+		return nil, E.New("udp message too short")
+	}
+	var m udpMessage
+	m.sessionID = binary.BigEndian.Uint32(data[0:4])
+	m.packetID = binary.BigEndian.Uint16(data[4:6])
+	m.fragID = data[6]
+	m.fragCount = data[7]
+	destLen := int(data[8])
+	if len(data) < 9+destLen {
+		return nil, E.New("udp message truncated address")
+	}
+	m.destination = M.ParseSocksaddr(string(data[9 : 9+destLen]))
+	m.data = data[9+destLen:]
+	return &m, nil
+}
+
+// udpPacketConn is a virtual net.PacketConn multiplexed over a single QUIC
+// connection's datagrams, keyed by sessionID. It is shared by both ends:
+// on the client it represents one ListenPacket call, and on the server it
+// represents one UDP association accepted from a client session. onRx/onTx,
+// when set, report decoded/encoded payload sizes for per-user traffic
+// accounting.
+type udpPacketConn struct {
+	ctx        context.Context
+	quicConn   quic.Connection
+	sessionID  uint32
+	packetID   uint16
+	onClose    func()
+	onRx       func(n uint64)
+	onTx       func(n uint64)
+	closeOnce  sync.Once
+	done       chan struct{}
+	readBuffer chan udpMessage
+
+	fragAccess sync.Mutex
+	fragments  map[uint16][][]byte
+	fragCount  map[uint16]uint8
+}
+
+func newUDPPacketConn(ctx context.Context, quicConn quic.Connection, onClose func()) *udpPacketConn {
+	return &udpPacketConn{
+		ctx:        ctx,
+		quicConn:   quicConn,
+		onClose:    onClose,
+		done:       make(chan struct{}),
+		readBuffer: make(chan udpMessage, 64),
+		fragments:  make(map[uint16][][]byte),
+		fragCount:  make(map[uint16]uint8),
+	}
+}
+
+func (c *udpPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	destination := M.SocksaddrFromNet(addr)
+	c.packetID++
+	packetID := c.packetID
+	if len(p) <= maxUDPMessageSize {
+		if err = c.writeFragment(packetID, 0, 1, destination, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	fragCount := (len(p) + maxUDPMessageSize - 1) / maxUDPMessageSize
+	for i := 0; i < fragCount; i++ {
+		start := i * maxUDPMessageSize
+		end := start + maxUDPMessageSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err = c.writeFragment(packetID, uint8(i), uint8(fragCount), destination, p[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *udpPacketConn) writeFragment(packetID uint16, fragID, fragCount uint8, destination M.Socksaddr, data []byte) error {
+	buffer := writeUDPMessage(udpMessage{
+		sessionID:   c.sessionID,
+		packetID:    packetID,
+		fragID:      fragID,
+		fragCount:   fragCount,
+		destination: destination,
+		data:        data,
+	})
+	defer buffer.Release()
+	err := baderror.WrapQUIC(c.quicConn.SendDatagram(buffer.Bytes()))
+	if err == nil && c.onTx != nil {
+		c.onTx(uint64(len(data)))
+	}
+	return err
+}
+
+// handleMessage reassembles an incoming udpMessage and, once complete,
+// delivers it to ReadFrom. It is invoked by the client's and server's
+// message loops alike.
+func (c *udpPacketConn) handleMessage(m *udpMessage) {
+	if m.fragCount <= 1 {
+		c.deliver(m.destination, m.data)
+		return
+	}
+	c.fragAccess.Lock()
+	defer c.fragAccess.Unlock()
+	parts, loaded := c.fragments[m.packetID]
+	if !loaded {
+		parts = make([][]byte, m.fragCount)
+		c.fragments[m.packetID] = parts
+		c.fragCount[m.packetID] = 0
+	}
+	if int(m.fragID) >= len(parts) || parts[m.fragID] != nil {
+		return
+	}
+	parts[m.fragID] = m.data
+	c.fragCount[m.packetID]++
+	if c.fragCount[m.packetID] != m.fragCount {
+		return
+	}
+	delete(c.fragments, m.packetID)
+	delete(c.fragCount, m.packetID)
+	var buffer bytes.Buffer
+	for _, part := range parts {
+		buffer.Write(part)
+	}
+	c.deliver(m.destination, buffer.Bytes())
+}
+
+func (c *udpPacketConn) deliver(destination M.Socksaddr, data []byte) {
+	if c.onRx != nil {
+		c.onRx(uint64(len(data)))
+	}
+	select {
+	case c.readBuffer <- udpMessage{destination: destination, data: data}:
+	case <-c.done:
+	}
+}
+
+func (c *udpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case message := <-c.readBuffer:
+		n = copy(p, message.data)
+		return n, message.destination.UDPAddr(), nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-c.ctx.Done():
+		return 0, nil, c.ctx.Err()
+	}
+}
+
+func (c *udpPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *udpPacketConn) LocalAddr() net.Addr {
+	return M.Socksaddr{}.UDPAddr()
+}
+
+func (c *udpPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// loopMessages demuxes incoming QUIC datagrams on the client side to the
+// udpPacketConn registered for each session.
+func (c *Client) loopMessages(conn *clientQUICConnection) {
+	for {
+		data, err := conn.quicConn.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return
+		}
+		message, err := readUDPMessage(data)
+		if err != nil {
+			continue
+		}
+		conn.udpAccess.RLock()
+		packetConn, loaded := conn.udpConnMap[message.sessionID]
+		conn.udpAccess.RUnlock()
+		if loaded {
+			packetConn.handleMessage(message)
+		}
+	}
+}
+
+// loopMessages demuxes incoming QUIC datagrams on the server side,
+// creating a udpPacketConn (and handing it to the configured ServerHandler)
+// the first time a session is seen.
+func (s *serverSession[U]) loopMessages() {
+	for {
+		data, err := s.quicConn.ReceiveDatagram(s.ctx)
+		if err != nil {
+			return
+		}
+		message, err := readUDPMessage(data)
+		if err != nil {
+			continue
+		}
+		s.handleUDPMessage(message)
+	}
+}
+
+func (s *serverSession[U]) handleUDPMessage(message *udpMessage) {
+	sessionID := message.sessionID
+	s.udpAccess.Lock()
+	packetConn, loaded := s.udpConnMap[sessionID]
+	if !loaded {
+		packetConn = newUDPPacketConn(s.ctx, s.quicConn, func() {
+			s.udpAccess.Lock()
+			delete(s.udpConnMap, sessionID)
+			s.udpAccess.Unlock()
+		})
+		packetConn.sessionID = sessionID
+		if s.trafficTracker != nil {
+			user := s.authUser
+			tracker := s.trafficTracker
+			packetConn.onRx = func(n uint64) { tracker.Push(user, 0, n) }
+			packetConn.onTx = func(n uint64) { tracker.Push(user, n, 0) }
+		}
+		s.udpConnMap[sessionID] = packetConn
+	}
+	s.udpAccess.Unlock()
+	if !loaded {
+		ctx := auth.ContextWithUser(s.ctx, s.authUser)
+		go func() {
+			_ = s.handler.NewPacketConnection(ctx, packetConn, M.Metadata{Source: s.source})
+		}()
+	}
+	packetConn.handleMessage(message)
+}
@@ -0,0 +1,405 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/MerlinKodo/quic-go"
+	qtls "github.com/MerlinKodo/sing-quic"
+	"github.com/MerlinKodo/sing-quic/tuic/internal/protocol"
+	"github.com/gofrs/uuid/v5"
+	"github.com/sagernet/sing/common/baderror"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	defaultStreamReceiveWindow = 8388608
+	defaultConnReceiveWindow   = defaultStreamReceiveWindow * 5 / 2
+	defaultMaxIdleTimeout      = 30 * time.Second
+	defaultKeepAlivePeriod     = 10 * time.Second
+	defaultHeartbeatInterval   = 10 * time.Second
+)
+
+const (
+	UDPRelayModeNative = "native"
+	UDPRelayModeQUIC   = "quic"
+)
+
+type ClientOptions struct {
+	Context           context.Context
+	Dialer            N.Dialer
+	Logger            logger.Logger
+	ServerAddress     M.Socksaddr
+	TLSConfig         *tls.Config
+	UUID              uuid.UUID
+	Password          string
+	CongestionControl string
+	UDPRelayMode      string
+	UDPDisabled       bool
+	ZeroRTTHandshake  bool
+	Heartbeat         time.Duration
+	CWND              int
+}
+
+type Client struct {
+	ctx               context.Context
+	dialer            N.Dialer
+	logger            logger.Logger
+	serverAddr        M.Socksaddr
+	tlsConfig         *tls.Config
+	quicConfig        *quic.Config
+	uuid              uuid.UUID
+	password          string
+	congestionControl string
+	udpRelayMode      string
+	udpDisabled       bool
+	zeroRTTHandshake  bool
+	heartbeat         time.Duration
+	cwnd              int
+
+	connAccess sync.RWMutex
+	conn       *clientQUICConnection
+}
+
+func NewClient(options ClientOptions) (*Client, error) {
+	quicConfig := &quic.Config{
+		DisablePathMTUDiscovery:        !(runtime.GOOS == "windows" || runtime.GOOS == "linux" || runtime.GOOS == "android" || runtime.GOOS == "darwin"),
+		EnableDatagrams:                !options.UDPDisabled,
+		InitialStreamReceiveWindow:     defaultStreamReceiveWindow,
+		MaxStreamReceiveWindow:         defaultStreamReceiveWindow,
+		InitialConnectionReceiveWindow: defaultConnReceiveWindow,
+		MaxConnectionReceiveWindow:     defaultConnReceiveWindow,
+		MaxIdleTimeout:                 defaultMaxIdleTimeout,
+		KeepAlivePeriod:                defaultKeepAlivePeriod,
+	}
+	heartbeat := options.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeatInterval
+	}
+	udpRelayMode := options.UDPRelayMode
+	if udpRelayMode == "" {
+		udpRelayMode = UDPRelayModeNative
+	}
+	if options.ZeroRTTHandshake && options.TLSConfig.ClientSessionCache == nil {
+		options.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	}
+	return &Client{
+		ctx:               options.Context,
+		dialer:            options.Dialer,
+		logger:            options.Logger,
+		serverAddr:        options.ServerAddress,
+		tlsConfig:         options.TLSConfig,
+		quicConfig:        quicConfig,
+		uuid:              options.UUID,
+		password:          options.Password,
+		congestionControl: options.CongestionControl,
+		udpRelayMode:      udpRelayMode,
+		udpDisabled:       options.UDPDisabled,
+		zeroRTTHandshake:  options.ZeroRTTHandshake,
+		heartbeat:         heartbeat,
+		cwnd:              options.CWND,
+	}, nil
+}
+
+func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
+	conn := c.conn
+	if conn != nil && conn.active() {
+		return conn, nil
+	}
+	c.connAccess.Lock()
+	defer c.connAccess.Unlock()
+	conn = c.conn
+	if conn != nil && conn.active() {
+		return conn, nil
+	}
+	conn, err := c.offerNew(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
+	conn, err := c.offerNewOnce(ctx)
+	if err != nil && c.zeroRTTHandshake && is0RTTRejected(err) {
+		// The server rejected our early data (e.g. it restarted and lost the
+		// session ticket's state); clear the cached ticket and retry once as
+		// a regular 1-RTT handshake instead of failing the dial outright.
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+		conn, err = c.offerNewOnce(ctx)
+	}
+	return conn, err
+}
+
+func is0RTTRejected(err error) bool {
+	return errors.Is(err, quic.Err0RTTRejected)
+}
+
+func (c *Client) offerNewOnce(ctx context.Context) (*clientQUICConnection, error) {
+	udpConn, err := c.dialer.DialContext(c.ctx, "udp", c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	var packetConn net.PacketConn
+	packetConn = bufio.NewUnbindPacketConn(udpConn)
+	quicConn, err := qtls.DialEarly(ctx, packetConn, c.serverAddr.UDPAddr(), c.tlsConfig, c.quicConfig)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	// The authenticate token is derived from the TLS exporter, which is
+	// only available once the handshake is confirmed (not merely started,
+	// as with early data) — wait for it regardless of ZeroRTTHandshake.
+	// ZeroRTTHandshake only speeds up reaching this point on a resumed
+	// connection; it doesn't let authentication itself skip the exporter.
+	select {
+	case <-quicConn.HandshakeComplete():
+	case <-ctx.Done():
+		quicConn.CloseWithError(0, "")
+		udpConn.Close()
+		return nil, ctx.Err()
+	}
+	setCongestionControl(quicConn, c.congestionControl, c.cwnd, c.logger)
+	authStream, err := quicConn.OpenUniStream()
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	token, err := protocol.GenerateToken(quicConn.ConnectionState().TLS.ExportKeyingMaterial, c.uuid, c.password)
+	if err != nil {
+		udpConn.Close()
+		return nil, E.Cause(err, "generate authenticate token")
+	}
+	buffer := protocol.WriteAuthenticate(c.uuid, token)
+	_, err = authStream.Write(buffer.Bytes())
+	buffer.Release()
+	authStream.Close()
+	if err != nil {
+		udpConn.Close()
+		return nil, E.Cause(err, "write authenticate command")
+	}
+	conn := &clientQUICConnection{
+		quicConn:   quicConn,
+		rawConn:    udpConn,
+		connDone:   make(chan struct{}),
+		udpConnMap: make(map[uint16]*udpPacketConn),
+	}
+	go c.loopHeartbeat(conn)
+	if !c.udpDisabled {
+		go c.loopMessages(conn)
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *Client) loopHeartbeat(conn *clientQUICConnection) {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.connDone:
+			return
+		case <-ticker.C:
+			stream, err := conn.quicConn.OpenUniStream()
+			if err != nil {
+				conn.closeWithError(E.Cause(err, "open heartbeat stream"))
+				return
+			}
+			buffer := protocol.WriteHeartbeat()
+			_, err = stream.Write(buffer.Bytes())
+			buffer.Release()
+			stream.Close()
+			if err != nil {
+				conn.closeWithError(E.Cause(err, "write heartbeat"))
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) loopMessages(conn *clientQUICConnection) {
+	go c.loopUniStreams(conn)
+	if c.udpRelayMode != UDPRelayModeQUIC {
+		go c.loopDatagrams(conn)
+	}
+}
+
+func (c *Client) loopUniStreams(conn *clientQUICConnection) {
+	for {
+		stream, err := conn.quicConn.AcceptUniStream(c.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			header := make([]byte, 2)
+			if _, hErr := io.ReadFull(stream, header); hErr != nil || header[0] != protocol.Version || header[1] != protocol.CommandPacket {
+				return
+			}
+			frame, fErr := protocol.ReadPacket(stream)
+			if fErr != nil {
+				return
+			}
+			conn.udpAccess.RLock()
+			packetConn, loaded := conn.udpConnMap[frame.SessionID]
+			conn.udpAccess.RUnlock()
+			if loaded {
+				packetConn.handlePacket(frame)
+			}
+		}()
+	}
+}
+
+func (c *Client) loopDatagrams(conn *clientQUICConnection) {
+	for {
+		data, err := conn.quicConn.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return
+		}
+		if len(data) < 2 || data[0] != protocol.Version || data[1] != protocol.CommandPacket {
+			continue
+		}
+		frame, err := protocol.ReadPacket(bytes.NewReader(data[2:]))
+		if err != nil {
+			continue
+		}
+		conn.udpAccess.RLock()
+		packetConn, loaded := conn.udpConnMap[frame.SessionID]
+		conn.udpAccess.RUnlock()
+		if loaded {
+			packetConn.handlePacket(frame)
+		}
+	}
+}
+
+func (c *Client) DialConn(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := c.offer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.quicConn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{
+		Stream:      stream,
+		destination: destination,
+	}, nil
+}
+
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if c.udpDisabled {
+		return nil, E.New("UDP disabled")
+	}
+	conn, err := c.offer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var sessionID uint16
+	clientPacketConn := newUDPPacketConn(c.ctx, conn, c.udpRelayMode, func() {
+		conn.udpAccess.Lock()
+		delete(conn.udpConnMap, sessionID)
+		conn.udpAccess.Unlock()
+	})
+	conn.udpAccess.Lock()
+	sessionID = conn.udpSessionID
+	conn.udpSessionID++
+	conn.udpConnMap[sessionID] = clientPacketConn
+	conn.udpAccess.Unlock()
+	clientPacketConn.sessionID = sessionID
+	return clientPacketConn, nil
+}
+
+func (c *Client) CloseWithError(err error) error {
+	conn := c.conn
+	if conn != nil {
+		conn.closeWithError(err)
+	}
+	return nil
+}
+
+type clientQUICConnection struct {
+	quicConn     quic.EarlyConnection
+	rawConn      net.Conn
+	closeOnce    sync.Once
+	connDone     chan struct{}
+	connErr      error
+	udpAccess    sync.RWMutex
+	udpConnMap   map[uint16]*udpPacketConn
+	udpSessionID uint16
+}
+
+func (c *clientQUICConnection) active() bool {
+	select {
+	case <-c.quicConn.Context().Done():
+		return false
+	default:
+	}
+	select {
+	case <-c.connDone:
+		return false
+	default:
+	}
+	return true
+}
+
+func (c *clientQUICConnection) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.connErr = err
+		close(c.connDone)
+		c.quicConn.CloseWithError(0, "")
+		c.rawConn.Close()
+	})
+}
+
+type clientConn struct {
+	quic.Stream
+	destination    M.Socksaddr
+	requestWritten bool
+}
+
+func (c *clientConn) NeedHandshake() bool {
+	return !c.requestWritten
+}
+
+func (c *clientConn) Read(p []byte) (n int, err error) {
+	n, err = c.Stream.Read(p)
+	return n, baderror.WrapQUIC(err)
+}
+
+func (c *clientConn) Write(p []byte) (n int, err error) {
+	if !c.requestWritten {
+		buffer := protocol.WriteConnect(c.destination)
+		_, err = c.Stream.Write(buffer.Bytes())
+		buffer.Release()
+		if err != nil {
+			return
+		}
+		c.requestWritten = true
+	}
+	n, err = c.Stream.Write(p)
+	return n, baderror.WrapQUIC(err)
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (c *clientConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
@@ -0,0 +1,20 @@
+package tuic
+
+import (
+	"github.com/MerlinKodo/quic-go"
+	"github.com/MerlinKodo/sing-quic/hysteria2"
+	"github.com/sagernet/sing/common/logger"
+)
+
+// setCongestionControl selects the congestion controller for a TUIC
+// connection, reusing the BBR/Brutal selection already implemented for
+// hysteria2 rather than duplicating it. TUIC has no bandwidth negotiation of
+// its own, so refBPS is always 0: selecting "brutal" here pins it to zero
+// target bandwidth and is effectively unusable, the same limitation as
+// hysteria2's named-registry path when no bandwidth is supplied.
+func setCongestionControl(quicConn quic.Connection, congestionControl string, cwnd int, logger logger.Logger) {
+	if congestionControl == "" {
+		congestionControl = "bbr"
+	}
+	hysteria2.SetCongestionController(quicConn, congestionControl, 0, cwnd, logger)
+}
@@ -0,0 +1,226 @@
+// Package protocol implements the TUIC v5 wire format: command framing for
+// Authenticate/Connect/Packet/Dissociate/Heartbeat as specified by
+// https://github.com/EAimTY/tuic/blob/dev/SPEC.md.
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const Version = 5
+
+const (
+	CommandAuthenticate byte = 0x00
+	CommandConnect      byte = 0x01
+	CommandPacket       byte = 0x02
+	CommandDissociate   byte = 0x03
+	CommandHeartbeat    byte = 0x04
+)
+
+const (
+	AddressTypeDomain byte = 0x00
+	AddressTypeIPv4   byte = 0x01
+	AddressTypeIPv6   byte = 0x02
+	AddressTypeNone   byte = 0xff
+)
+
+// TokenSize is the length, in bytes, of the TLS-exporter derived
+// authentication token carried by the Authenticate command.
+const TokenSize = 32
+
+// GenerateToken derives the per-connection authentication token from the
+// TLS exporter keying material, the client UUID and password, as required
+// by the TUIC v5 handshake.
+func GenerateToken(export func(label string, context []byte, length int) ([]byte, error), userUUID uuid.UUID, password string) ([32]byte, error) {
+	var token [32]byte
+	material, err := export(string(userUUID.Bytes())+password, nil, TokenSize)
+	if err != nil {
+		return token, E.Cause(err, "export TLS keying material")
+	}
+	copy(token[:], material)
+	return token, nil
+}
+
+func WriteAuthenticate(userUUID uuid.UUID, token [32]byte) *buf.Buffer {
+	buffer := buf.NewSize(2 + 16 + TokenSize)
+	buffer.Write([]byte{Version, CommandAuthenticate})
+	buffer.Write(userUUID.Bytes())
+	buffer.Write(token[:])
+	return buffer
+}
+
+func ReadAuthenticate(reader io.Reader) (uuid.UUID, [32]byte, error) {
+	var token [32]byte
+	var userUUID uuid.UUID
+	idBytes := make([]byte, 16)
+	if _, err := io.ReadFull(reader, idBytes); err != nil {
+		return userUUID, token, E.Cause(err, "read uuid")
+	}
+	copy(userUUID[:], idBytes)
+	if _, err := io.ReadFull(reader, token[:]); err != nil {
+		return userUUID, token, E.Cause(err, "read token")
+	}
+	return userUUID, token, nil
+}
+
+func WriteConnect(destination M.Socksaddr) *buf.Buffer {
+	buffer := buf.NewSize(2 + addressLen(destination))
+	buffer.Write([]byte{Version, CommandConnect})
+	writeAddress(buffer, destination)
+	return buffer
+}
+
+func ReadConnect(reader io.Reader) (M.Socksaddr, error) {
+	return readAddress(reader)
+}
+
+func WriteHeartbeat() *buf.Buffer {
+	buffer := buf.NewSize(2)
+	buffer.Write([]byte{Version, CommandHeartbeat})
+	return buffer
+}
+
+func WriteDissociate(sessionID uint16) *buf.Buffer {
+	buffer := buf.NewSize(4)
+	buffer.Write([]byte{Version, CommandDissociate})
+	common.Must(binary.Write(buffer, binary.BigEndian, sessionID))
+	return buffer
+}
+
+// Packet is a single (possibly fragmented) UDP relay frame as carried over
+// either a QUIC datagram or a unidirectional stream, depending on the
+// negotiated UDPRelayMode.
+type Packet struct {
+	SessionID     uint16
+	PacketID      uint16
+	FragmentID    uint8
+	FragmentCount uint8
+	Size          uint16
+	Destination   M.Socksaddr
+	Data          []byte
+}
+
+func WritePacket(p Packet) *buf.Buffer {
+	buffer := buf.NewSize(2 + 2 + 2 + 1 + 1 + 2 + addressLen(p.Destination) + len(p.Data))
+	buffer.Write([]byte{Version, CommandPacket})
+	common.Must(binary.Write(buffer, binary.BigEndian, p.SessionID))
+	common.Must(binary.Write(buffer, binary.BigEndian, p.PacketID))
+	buffer.WriteByte(p.FragmentID)
+	buffer.WriteByte(p.FragmentCount)
+	common.Must(binary.Write(buffer, binary.BigEndian, p.Size))
+	writeAddress(buffer, p.Destination)
+	buffer.Write(p.Data)
+	return buffer
+}
+
+func ReadPacket(reader io.Reader) (*Packet, error) {
+	var p Packet
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, E.Cause(err, "read packet header")
+	}
+	p.SessionID = binary.BigEndian.Uint16(header[0:2])
+	p.PacketID = binary.BigEndian.Uint16(header[2:4])
+	p.FragmentID = header[4]
+	p.FragmentCount = header[5]
+	p.Size = binary.BigEndian.Uint16(header[6:8])
+	destination, err := readAddress(reader)
+	if err != nil {
+		return nil, E.Cause(err, "read packet address")
+	}
+	p.Destination = destination
+	data := make([]byte, p.Size)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return nil, E.Cause(err, "read packet payload")
+	}
+	p.Data = data
+	return &p, nil
+}
+
+func addressLen(destination M.Socksaddr) int {
+	switch {
+	case destination.IsFqdn():
+		return 1 + 1 + len(destination.Fqdn) + 2
+	case destination.IsValid() && destination.Addr.Is4():
+		return 1 + 4 + 2
+	case destination.IsValid():
+		return 1 + 16 + 2
+	default:
+		return 1
+	}
+}
+
+func writeAddress(buffer *buf.Buffer, destination M.Socksaddr) {
+	switch {
+	case destination.IsFqdn():
+		buffer.WriteByte(AddressTypeDomain)
+		buffer.WriteByte(byte(len(destination.Fqdn)))
+		buffer.Write([]byte(destination.Fqdn))
+		common.Must(binary.Write(buffer, binary.BigEndian, destination.Port))
+	case destination.IsValid() && destination.Addr.Is4():
+		buffer.WriteByte(AddressTypeIPv4)
+		buffer.Write(destination.Addr.AsSlice())
+		common.Must(binary.Write(buffer, binary.BigEndian, destination.Port))
+	case destination.IsValid():
+		buffer.WriteByte(AddressTypeIPv6)
+		buffer.Write(destination.Addr.AsSlice())
+		common.Must(binary.Write(buffer, binary.BigEndian, destination.Port))
+	default:
+		buffer.WriteByte(AddressTypeNone)
+	}
+}
+
+func readAddress(reader io.Reader) (M.Socksaddr, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(reader, addrType); err != nil {
+		return M.Socksaddr{}, E.Cause(err, "read address type")
+	}
+	switch addrType[0] {
+	case AddressTypeNone:
+		return M.Socksaddr{}, nil
+	case AddressTypeDomain:
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(reader, lengthByte); err != nil {
+			return M.Socksaddr{}, E.Cause(err, "read domain length")
+		}
+		domain := make([]byte, lengthByte[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return M.Socksaddr{}, E.Cause(err, "read domain")
+		}
+		var port uint16
+		if err := binary.Read(reader, binary.BigEndian, &port); err != nil {
+			return M.Socksaddr{}, E.Cause(err, "read port")
+		}
+		return M.Socksaddr{Fqdn: string(domain), Port: port}, nil
+	case AddressTypeIPv4, AddressTypeIPv6:
+		addrLen := 4
+		if addrType[0] == AddressTypeIPv6 {
+			addrLen = 16
+		}
+		addr := make([]byte, addrLen)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return M.Socksaddr{}, E.Cause(err, "read address")
+		}
+		var port uint16
+		if err := binary.Read(reader, binary.BigEndian, &port); err != nil {
+			return M.Socksaddr{}, E.Cause(err, "read port")
+		}
+		var ip netip.Addr
+		if addrLen == 4 {
+			ip = netip.AddrFrom4([4]byte(addr))
+		} else {
+			ip = netip.AddrFrom16([16]byte(addr))
+		}
+		return M.SocksaddrFrom(ip, port), nil
+	default:
+		return M.Socksaddr{}, E.New("unknown address type ", addrType[0])
+	}
+}
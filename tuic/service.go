@@ -0,0 +1,396 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	qtls "github.com/MerlinKodo/sing-quic"
+
+	"github.com/MerlinKodo/quic-go"
+	"github.com/MerlinKodo/sing-quic/tuic/internal/protocol"
+	"github.com/gofrs/uuid/v5"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/baderror"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type ServiceOptions struct {
+	Context           context.Context
+	Logger            logger.Logger
+	TLSConfig         *tls.Config
+	CongestionControl string
+	UDPDisabled       bool
+	Handler           ServerHandler
+	CWND              int
+}
+
+type ServerHandler interface {
+	N.TCPConnectionHandler
+	N.UDPConnectionHandler
+}
+
+type Service[U comparable] struct {
+	ctx               context.Context
+	logger            logger.Logger
+	tlsConfig         *tls.Config
+	quicConfig        *quic.Config
+	congestionControl string
+	udpDisabled       bool
+	handler           ServerHandler
+	quicListener      io.Closer
+	cwnd              int
+
+	userAccess sync.RWMutex
+	userMap    map[uuid.UUID]userEntry[U]
+}
+
+type userEntry[U comparable] struct {
+	user     U
+	password string
+}
+
+func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
+	quicConfig := &quic.Config{
+		EnableDatagrams:    !options.UDPDisabled,
+		MaxIncomingStreams: 1 << 60,
+		MaxIdleTimeout:     defaultMaxIdleTimeout,
+		KeepAlivePeriod:    defaultKeepAlivePeriod,
+	}
+	return &Service[U]{
+		ctx:               options.Context,
+		logger:            options.Logger,
+		tlsConfig:         options.TLSConfig,
+		quicConfig:        quicConfig,
+		congestionControl: options.CongestionControl,
+		udpDisabled:       options.UDPDisabled,
+		handler:           options.Handler,
+		cwnd:              options.CWND,
+		userMap:           make(map[uuid.UUID]userEntry[U]),
+	}, nil
+}
+
+func (s *Service[U]) UpdateUsers(users []U, uuidList []uuid.UUID, passwordList []string) {
+	userMap := make(map[uuid.UUID]userEntry[U])
+	for i, user := range users {
+		userMap[uuidList[i]] = userEntry[U]{user: user, password: passwordList[i]}
+	}
+	s.userAccess.Lock()
+	s.userMap = userMap
+	s.userAccess.Unlock()
+}
+
+func (s *Service[U]) Start(conn net.PacketConn) error {
+	err := qtls.ConfigureHTTP3(s.tlsConfig)
+	if err != nil {
+		return err
+	}
+	listener, err := qtls.ListenEarly(conn, s.tlsConfig, s.quicConfig)
+	if err != nil {
+		return err
+	}
+	s.quicListener = listener
+	go s.loopConnections(listener)
+	return nil
+}
+
+func (s *Service[U]) Close() error {
+	return common.Close(
+		s.quicListener,
+	)
+}
+
+func (s *Service[U]) loopConnections(listener qtls.EarlyListener) {
+	for {
+		connection, err := listener.Accept(s.ctx)
+		if err != nil {
+			if E.IsClosedOrCanceled(err) {
+				s.logger.Debug(E.Cause(err, "listener closed"))
+			} else {
+				s.logger.Error(E.Cause(err, "listener closed"))
+			}
+			return
+		}
+		go s.handleConnection(connection)
+	}
+}
+
+func (s *Service[U]) handleConnection(connection quic.EarlyConnection) {
+	session := &serverSession[U]{
+		Service:    s,
+		ctx:        s.ctx,
+		quicConn:   connection,
+		source:     M.SocksaddrFromNet(connection.RemoteAddr()),
+		connDone:   make(chan struct{}),
+		udpConnMap: make(map[uint16]*serverPacketConn[U]),
+	}
+	session.handle()
+}
+
+type serverSession[U comparable] struct {
+	*Service[U]
+	ctx           context.Context
+	quicConn      quic.EarlyConnection
+	source        M.Socksaddr
+	connAccess    sync.Mutex
+	connDone      chan struct{}
+	connErr       error
+	authenticated bool
+	authUser      U
+	udpAccess     sync.RWMutex
+	udpConnMap    map[uint16]*serverPacketConn[U]
+}
+
+func (s *serverSession[U]) handle() {
+	go s.loopUniStreams()
+	if !s.udpDisabled {
+		go s.loopDatagrams()
+	}
+	for {
+		stream, err := s.quicConn.AcceptStream(s.ctx)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		go func() {
+			hErr := s.handleStream(stream)
+			if hErr != nil {
+				stream.CancelRead(0)
+				stream.Close()
+				if !E.IsClosedOrCanceled(hErr) {
+					s.logger.Error(E.Cause(hErr, "handle stream request"))
+				}
+			}
+		}()
+	}
+}
+
+func (s *serverSession[U]) loopUniStreams() {
+	for {
+		stream, err := s.quicConn.AcceptUniStream(s.ctx)
+		if err != nil {
+			return
+		}
+		go s.handleUniStream(stream)
+	}
+}
+
+func (s *serverSession[U]) handleUniStream(stream quic.ReceiveStream) {
+	reader := io.Reader(stream)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if header[0] != protocol.Version {
+		return
+	}
+	switch header[1] {
+	case protocol.CommandAuthenticate:
+		s.handleAuthenticate(reader)
+	case protocol.CommandPacket:
+		frame, err := protocol.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+		s.handlePacketFrame(frame)
+	case protocol.CommandHeartbeat, protocol.CommandDissociate:
+		// no server-side action required beyond keeping the connection alive
+	}
+}
+
+func (s *serverSession[U]) handleAuthenticate(reader io.Reader) {
+	clientUUID, token, err := protocol.ReadAuthenticate(reader)
+	if err != nil {
+		return
+	}
+	s.userAccess.RLock()
+	entry, loaded := s.userMap[clientUUID]
+	s.userAccess.RUnlock()
+	if !loaded {
+		return
+	}
+	expected, err := protocol.GenerateToken(s.quicConn.ConnectionState().TLS.ExportKeyingMaterial, clientUUID, entry.password)
+	if err != nil || subtle.ConstantTimeCompare(expected[:], token[:]) != 1 {
+		return
+	}
+	s.authUser = entry.user
+	s.authenticated = true
+	setCongestionControl(s.quicConn, s.congestionControl, s.cwnd, s.logger)
+}
+
+func (s *serverSession[U]) handleStream(stream quic.Stream) error {
+	if !s.authenticated {
+		return E.New("connection not authenticated")
+	}
+	destination, err := protocol.ReadConnect(stream)
+	if err != nil {
+		return E.Cause(err, "read connect request")
+	}
+	ctx := auth.ContextWithUser(s.ctx, s.authUser)
+	_ = s.handler.NewConnection(ctx, &serverConn{Stream: stream}, M.Metadata{
+		Source:      s.source,
+		Destination: destination,
+	})
+	return nil
+}
+
+func (s *serverSession[U]) loopDatagrams() {
+	for {
+		data, err := s.quicConn.ReceiveDatagram(s.ctx)
+		if err != nil {
+			return
+		}
+		if len(data) < 2 || data[0] != protocol.Version || data[1] != protocol.CommandPacket {
+			continue
+		}
+		frame, err := protocol.ReadPacket(bytes.NewReader(data[2:]))
+		if err != nil {
+			continue
+		}
+		s.handlePacketFrame(frame)
+	}
+}
+
+func (s *serverSession[U]) handlePacketFrame(frame *protocol.Packet) {
+	if !s.authenticated {
+		return
+	}
+	s.udpAccess.Lock()
+	packetConn, loaded := s.udpConnMap[frame.SessionID]
+	if !loaded {
+		packetConn = newServerPacketConn(s, frame.SessionID)
+		s.udpConnMap[frame.SessionID] = packetConn
+	}
+	s.udpAccess.Unlock()
+	if !loaded {
+		ctx := auth.ContextWithUser(s.ctx, s.authUser)
+		go func() {
+			_ = s.handler.NewPacketConnection(ctx, packetConn, M.Metadata{
+				Source:      s.source,
+				Destination: frame.Destination,
+			})
+		}()
+	}
+	packetConn.deliver(frame.Destination, frame.Data)
+}
+
+func (s *serverSession[U]) closeWithError(err error) {
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+	select {
+	case <-s.connDone:
+		return
+	default:
+		s.connErr = err
+		close(s.connDone)
+	}
+	if E.IsClosedOrCanceled(err) {
+		s.logger.Debug(E.Cause(err, "connection failed"))
+	} else {
+		s.logger.Error(E.Cause(err, "connection failed"))
+	}
+	_ = s.quicConn.CloseWithError(0, "")
+}
+
+type serverConn struct {
+	quic.Stream
+}
+
+func (c *serverConn) Read(p []byte) (n int, err error) {
+	n, err = c.Stream.Read(p)
+	return n, baderror.WrapQUIC(err)
+}
+
+func (c *serverConn) Write(p []byte) (n int, err error) {
+	n, err = c.Stream.Write(p)
+	return n, baderror.WrapQUIC(err)
+}
+
+func (c *serverConn) LocalAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (c *serverConn) RemoteAddr() net.Addr {
+	return M.Socksaddr{}
+}
+
+func (c *serverConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// serverPacketConn represents a single UDP association accepted from a
+// client session; writes are relayed back as Packet frames over whichever
+// transport (datagram or uni stream) the association was opened on.
+type serverPacketConn[U comparable] struct {
+	session    *serverSession[U]
+	sessionID  uint16
+	packetID   uint16
+	readBuffer chan udpPacket
+}
+
+func newServerPacketConn[U comparable](session *serverSession[U], sessionID uint16) *serverPacketConn[U] {
+	return &serverPacketConn[U]{
+		session:    session,
+		sessionID:  sessionID,
+		readBuffer: make(chan udpPacket, 64),
+	}
+}
+
+func (c *serverPacketConn[U]) deliver(destination M.Socksaddr, data []byte) {
+	select {
+	case c.readBuffer <- udpPacket{destination: destination, data: data}:
+	case <-c.session.connDone:
+	}
+}
+
+func (c *serverPacketConn[U]) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.packetID++
+	buffer := protocol.WritePacket(protocol.Packet{
+		SessionID:     c.sessionID,
+		PacketID:      c.packetID,
+		FragmentCount: 1,
+		Size:          uint16(len(p)),
+		Destination:   M.SocksaddrFromNet(addr),
+		Data:          p,
+	})
+	defer buffer.Release()
+	if c.session.udpDisabled {
+		return 0, net.ErrClosed
+	}
+	if err = c.session.quicConn.SendDatagram(buffer.Bytes()); err != nil {
+		return 0, baderror.WrapQUIC(err)
+	}
+	return len(p), nil
+}
+
+func (c *serverPacketConn[U]) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case packet := <-c.readBuffer:
+		n = copy(p, packet.data)
+		return n, packet.destination.UDPAddr(), nil
+	case <-c.session.connDone:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *serverPacketConn[U]) Close() error {
+	return nil
+}
+
+func (c *serverPacketConn[U]) LocalAddr() net.Addr {
+	return M.Socksaddr{}.UDPAddr()
+}
+
+func (c *serverPacketConn[U]) SetDeadline(t time.Time) error      { return nil }
+func (c *serverPacketConn[U]) SetReadDeadline(t time.Time) error  { return nil }
+func (c *serverPacketConn[U]) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,187 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MerlinKodo/sing-quic/tuic/internal/protocol"
+	"github.com/sagernet/sing/common/baderror"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// maxPacketSize is the largest payload carried in a single QUIC datagram
+// before a packet has to be fragmented across several Packet frames.
+const maxPacketSize = 1400
+
+type udpPacketConn struct {
+	ctx        context.Context
+	conn       *clientQUICConnection
+	relayMode  string
+	sessionID  uint16
+	packetID   uint16
+	onClose    func()
+	closeOnce  sync.Once
+	done       chan struct{}
+	readBuffer chan udpPacket
+
+	fragAccess sync.Mutex
+	fragments  map[uint16][][]byte
+	fragCount  map[uint16]uint8
+}
+
+type udpPacket struct {
+	destination M.Socksaddr
+	data        []byte
+}
+
+func newUDPPacketConn(ctx context.Context, conn *clientQUICConnection, relayMode string, onClose func()) *udpPacketConn {
+	return &udpPacketConn{
+		ctx:        ctx,
+		conn:       conn,
+		relayMode:  relayMode,
+		onClose:    onClose,
+		done:       make(chan struct{}),
+		readBuffer: make(chan udpPacket, 64),
+		fragments:  make(map[uint16][][]byte),
+		fragCount:  make(map[uint16]uint8),
+	}
+}
+
+func (c *udpPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	destination := M.SocksaddrFromNet(addr)
+	c.packetID++
+	packetID := c.packetID
+	if len(p) <= maxPacketSize || c.relayMode == UDPRelayModeQUIC {
+		// Uni stream frames (relayMode "quic") aren't limited by path MTU the
+		// way a QUIC datagram is, so they never need to be split; only the
+		// default datagram relay has to fragment once the payload exceeds
+		// maxPacketSize.
+		err = c.writeFragment(packetID, 0, 1, destination, p)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	fragCount := (len(p) + maxPacketSize - 1) / maxPacketSize
+	for i := 0; i < fragCount; i++ {
+		start := i * maxPacketSize
+		end := start + maxPacketSize
+		if end > len(p) {
+			end = len(p)
+		}
+		err = c.writeFragment(packetID, uint8(i), uint8(fragCount), destination, p[start:end])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *udpPacketConn) writeFragment(packetID uint16, fragID, fragCount uint8, destination M.Socksaddr, data []byte) error {
+	frame := protocol.Packet{
+		SessionID:     c.sessionID,
+		PacketID:      packetID,
+		FragmentID:    fragID,
+		FragmentCount: fragCount,
+		Size:          uint16(len(data)),
+		Destination:   destination,
+		Data:          data,
+	}
+	buffer := protocol.WritePacket(frame)
+	defer buffer.Release()
+	if c.relayMode == UDPRelayModeQUIC {
+		stream, err := c.conn.quicConn.OpenUniStream()
+		if err != nil {
+			return baderror.WrapQUIC(err)
+		}
+		_, err = stream.Write(buffer.Bytes())
+		stream.Close()
+		return baderror.WrapQUIC(err)
+	}
+	return c.conn.quicConn.SendDatagram(buffer.Bytes())
+}
+
+// handlePacket reassembles an incoming Packet frame and, once complete,
+// delivers it to ReadFrom. It is invoked by the client's message loop for
+// both datagram- and stream-carried frames.
+func (c *udpPacketConn) handlePacket(frame *protocol.Packet) {
+	if frame.FragmentCount <= 1 {
+		c.deliver(frame.Destination, frame.Data)
+		return
+	}
+	c.fragAccess.Lock()
+	defer c.fragAccess.Unlock()
+	parts, loaded := c.fragments[frame.PacketID]
+	if !loaded {
+		parts = make([][]byte, frame.FragmentCount)
+		c.fragments[frame.PacketID] = parts
+		c.fragCount[frame.PacketID] = 0
+	}
+	if int(frame.FragmentID) >= len(parts) || parts[frame.FragmentID] != nil {
+		return
+	}
+	parts[frame.FragmentID] = frame.Data
+	c.fragCount[frame.PacketID]++
+	if c.fragCount[frame.PacketID] != frame.FragmentCount {
+		return
+	}
+	delete(c.fragments, frame.PacketID)
+	delete(c.fragCount, frame.PacketID)
+	var buffer bytes.Buffer
+	for _, part := range parts {
+		buffer.Write(part)
+	}
+	c.deliver(frame.Destination, buffer.Bytes())
+}
+
+func (c *udpPacketConn) deliver(destination M.Socksaddr, data []byte) {
+	select {
+	case c.readBuffer <- udpPacket{destination: destination, data: data}:
+	case <-c.done:
+	}
+}
+
+func (c *udpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case packet := <-c.readBuffer:
+		n = copy(p, packet.data)
+		return n, packet.destination.UDPAddr(), nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-c.ctx.Done():
+		return 0, nil, c.ctx.Err()
+	}
+}
+
+func (c *udpPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if stream, err := c.conn.quicConn.OpenUniStream(); err == nil {
+			buffer := protocol.WriteDissociate(c.sessionID)
+			stream.Write(buffer.Bytes())
+			buffer.Release()
+			stream.Close()
+		}
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *udpPacketConn) LocalAddr() net.Addr {
+	return M.Socksaddr{}.UDPAddr()
+}
+
+func (c *udpPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}